@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// Message is the in-memory representation of a single payload as it
+// crosses the codec boundary, independent of whatever framing stdin and
+// stdout use.
+type Message struct {
+	Body        []byte
+	ContentType string
+	RoutingKey  string
+	Headers     amqp.Table
+}
+
+// Codec frames messages read from stdin for publish and written to
+// stdout for consume, decoupling pipecat's wire format from AMQP.
+type Codec interface {
+	// Decode reads the next message to publish from r, returning io.EOF
+	// once there is nothing left to read.
+	Decode(r *bufio.Reader) (Message, error)
+	// Encode writes a delivered message to w.
+	Encode(w io.Writer, m Message) error
+}
+
+// codecFor returns the Codec registered under name, or nil if name isn't
+// one of "line", "null", "length-prefixed" or "json-lines". An empty name
+// selects "line".
+func codecFor(name string) Codec {
+	switch name {
+	case "", "line":
+		return lineCodec{}
+	case "null":
+		return nullCodec{}
+	case "length-prefixed":
+		return lengthPrefixedCodec{}
+	case "json-lines":
+		return jsonLinesCodec{}
+	default:
+		return nil
+	}
+}
+
+// lineCodec is pipecat's original newline-delimited text/plain framing.
+type lineCodec struct{}
+
+func (lineCodec) Decode(r *bufio.Reader) (Message, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err != io.EOF || len(line) == 0 {
+			return Message{}, err
+		}
+	}
+	return Message{Body: []byte(strings.TrimSuffix(line, "\n")), ContentType: "text/plain"}, nil
+}
+
+func (lineCodec) Encode(w io.Writer, m Message) error {
+	_, err := fmt.Fprintln(w, string(m.Body))
+	return err
+}
+
+// nullCodec frames messages as NUL-delimited bytes, so a body may safely
+// contain newlines or any other byte except NUL, which always ends a body.
+type nullCodec struct{}
+
+func (nullCodec) Decode(r *bufio.Reader) (Message, error) {
+	body, err := r.ReadBytes(0)
+	if err != nil {
+		if err != io.EOF || len(body) == 0 {
+			return Message{}, err
+		}
+		return Message{Body: body, ContentType: "application/octet-stream"}, nil
+	}
+	return Message{Body: body[:len(body)-1], ContentType: "application/octet-stream"}, nil
+}
+
+func (nullCodec) Encode(w io.Writer, m Message) error {
+	if _, err := w.Write(m.Body); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{0})
+	return err
+}
+
+// lengthPrefixedCodec frames each message as a big-endian uint32 byte
+// count followed by that many bytes of body, for arbitrary binary payloads.
+type lengthPrefixedCodec struct{}
+
+func (lengthPrefixedCodec) Decode(r *bufio.Reader) (Message, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return Message{}, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Message{}, err
+	}
+	return Message{Body: body, ContentType: "application/octet-stream"}, nil
+}
+
+func (lengthPrefixedCodec) Encode(w io.Writer, m Message) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(m.Body))); err != nil {
+		return err
+	}
+	_, err := w.Write(m.Body)
+	return err
+}
+
+// jsonLine is the on-the-wire shape of a single json-lines message,
+// letting the caller control per-message AMQP properties from stdin.
+type jsonLine struct {
+	Body        string            `json:"body"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	RoutingKey  string            `json:"routing_key,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+}
+
+// jsonLinesCodec frames each message as one JSON object per line, giving
+// stdin control over routing key, content type and headers per message.
+type jsonLinesCodec struct{}
+
+func (jsonLinesCodec) Decode(r *bufio.Reader) (Message, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err != io.EOF || strings.TrimSpace(line) == "" {
+			return Message{}, err
+		}
+	}
+
+	var jl jsonLine
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &jl); err != nil {
+		return Message{}, fmt.Errorf("invalid json-lines input: %s", err)
+	}
+
+	contentType := jl.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	var headers amqp.Table
+	if len(jl.Headers) > 0 {
+		headers = amqp.Table{}
+		for k, v := range jl.Headers {
+			headers[k] = v
+		}
+	}
+
+	return Message{
+		Body:        []byte(jl.Body),
+		ContentType: contentType,
+		RoutingKey:  jl.RoutingKey,
+		Headers:     headers,
+	}, nil
+}
+
+func (jsonLinesCodec) Encode(w io.Writer, m Message) error {
+	jl := jsonLine{
+		Body:        string(m.Body),
+		RoutingKey:  m.RoutingKey,
+		ContentType: m.ContentType,
+	}
+	if len(m.Headers) > 0 {
+		jl.Headers = make(map[string]string, len(m.Headers))
+		for k, v := range m.Headers {
+			jl.Headers[k] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	encoded, err := json.Marshal(jl)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(encoded))
+	return err
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,26 +22,43 @@ func failOnError(err error, msg string) {
 	}
 }
 
-func prepare(amqpUri string, queueName string, createQueue bool) (*amqp.Connection, *amqp.Channel) {
-	conn, err := amqp.Dial(amqpUri)
-	failOnError(err, "Failed to connect to AMQP broker")
-
-	channel, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
-
-	if createQueue == true {
-		_, err = channel.QueueDeclare(
-			queueName, // name
-			true,      // durable
-			false,     // delete when unused
-			false,     // exclusive
-			false,     // no-wait
-			nil,       // arguments
-		)
-		failOnError(err, "Failed to declare queue")
+func declareQueue(channel *amqp.Channel, queueName string) {
+	_, err := channel.QueueDeclare(
+		queueName, // name
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		nil,       // arguments
+	)
+	failOnError(err, "Failed to declare queue")
+}
+
+// declareExchange declares the named exchange of the given type if
+// exchangeName is non-empty. It is a no-op for the default, unnamed
+// exchange, which always exists and cannot be declared.
+func declareExchange(channel *amqp.Channel, exchangeName string, exchangeType string) {
+	if exchangeName == "" {
+		return
 	}
+	err := channel.ExchangeDeclare(
+		exchangeName, // name
+		exchangeType, // type
+		true,         // durable
+		false,        // auto-deleted
+		false,        // internal
+		false,        // no-wait
+		nil,          // arguments
+	)
+	failOnError(err, "Failed to declare exchange")
+}
 
-	return conn, channel
+// pendingPublish tracks a message that has been published but not yet
+// confirmed by the broker.
+type pendingPublish struct {
+	tag    uint64
+	msg    Message
+	sentAt time.Time
 }
 
 func publish(c *cli.Context) {
@@ -47,10 +67,11 @@ func publish(c *cli.Context) {
 		fmt.Println("Please provide name of the queue")
 		os.Exit(1)
 	}
-	conn, channel := prepare(c.String("amqpuri"), queueName, !c.Bool("no-create-queue"))
 
-	defer conn.Close()
-	defer channel.Close()
+	codec := codecFor(c.String("codec"))
+	if codec == nil {
+		failOnError(fmt.Errorf("unknown codec %q", c.String("codec")), "Failed to start publish")
+	}
 
 	// It is better to have a durable delivery mode and let user disable it
 	// even though it is not the RabbitMQ default
@@ -59,113 +80,450 @@ func publish(c *cli.Context) {
 		deliveryMode = 1
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		line := scanner.Text()
-		err := channel.Publish(
-			c.String("exchange"), // exchange
-			queueName,            // routing key
-			false,                // mandatory
-			false,                // immediate
-			amqp.Publishing{
-				ContentType:  "text/plain",
-				Body:         []byte(line),
-				DeliveryMode: deliveryMode,
-			})
-
-		failOnError(err, "Failed to publish a message")
-		fmt.Println(line)
-	}
-	err := scanner.Err()
-	failOnError(err, "Failed to read from stdin")
+	confirmMode := c.Bool("confirm")
+	inFlight := c.Int("in-flight")
+	if inFlight <= 0 {
+		inFlight = 1
+	}
+	confirmTimeout := c.Duration("confirm-timeout")
+	if confirmMode && confirmTimeout <= 0 {
+		failOnError(fmt.Errorf("--confirm-timeout must be greater than zero"), "Failed to start publish")
+	}
+
+	defaultRoutingKey := c.String("routing-key")
+	if defaultRoutingKey == "" {
+		defaultRoutingKey = queueName
+	}
+
+	sessions := redial(c.String("amqpuri"), c.Int("max-retries"), c.Duration("reconnect-delay"))
+	reader := bufio.NewReader(os.Stdin)
+
+	// messages that still need to be (re)sent, oldest first: messages
+	// nacked, timed out, or orphaned by a reconnect are requeued at the front
+	var mutex sync.Mutex
+	var backlog []Message
+
+	requeue := func(m Message) {
+		mutex.Lock()
+		backlog = append([]Message{m}, backlog...)
+		mutex.Unlock()
+	}
+
+	nextBacklogMessage := func() (Message, bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(backlog) == 0 {
+			return Message{}, false
+		}
+		m := backlog[0]
+		backlog = backlog[1:]
+		return m, true
+	}
+
+	eof := false
+	var readErr error
+
+	for sessCh := range sessions {
+		sess, ok := <-sessCh
+		if !ok {
+			failOnError(fmt.Errorf("reconnect attempts exhausted"), "Failed to connect to AMQP broker")
+		}
+
+		if c.Bool("exchange-declare") {
+			declareExchange(sess.Channel, c.String("exchange"), c.String("exchange-type"))
+		}
+		if !c.Bool("no-create-queue") {
+			declareQueue(sess.Channel, queueName)
+		}
+
+		var pending []pendingPublish
+		sem := make(chan struct{}, inFlight)
+
+		if confirmMode {
+			failOnError(sess.Channel.Confirm(false), "Failed to put channel into confirm mode")
+			confirms := sess.Channel.NotifyPublish(make(chan amqp.Confirmation, inFlight))
+
+			go func() {
+				ticker := time.NewTicker(confirmTimeout)
+				defer ticker.Stop()
+				for {
+					select {
+					case conf, ok := <-confirms:
+						if !ok {
+							return
+						}
+						mutex.Lock()
+						matched := false
+						for i, p := range pending {
+							if p.tag != conf.DeliveryTag {
+								continue
+							}
+							if conf.Ack {
+								codec.Encode(os.Stdout, p.msg)
+							} else {
+								log.Printf("broker nacked delivery tag %d, requeueing", p.tag)
+								backlog = append([]Message{p.msg}, backlog...)
+							}
+							pending = append(pending[:i], pending[i+1:]...)
+							matched = true
+							break
+						}
+						mutex.Unlock()
+						// A tag already evicted by the timeout branch (which
+						// released its own semaphore slot) gets its real,
+						// late confirm here with nothing left in pending to
+						// match; don't steal a slot that belongs to a
+						// still-genuinely-pending message.
+						if matched {
+							<-sem
+						}
+					case <-ticker.C:
+						mutex.Lock()
+						if len(pending) > 0 && time.Since(pending[0].sentAt) > confirmTimeout {
+							log.Printf("timed out waiting for confirm of delivery tag %d, requeueing", pending[0].tag)
+							backlog = append([]Message{pending[0].msg}, backlog...)
+							pending = pending[1:]
+							mutex.Unlock()
+							<-sem
+						} else {
+							mutex.Unlock()
+						}
+					}
+				}
+			}()
+		}
+
+		closed := sess.Connection.NotifyClose(make(chan *amqp.Error, 1))
+		reconnect := false
+		var tag uint64
+
+	publishLoop:
+		for {
+			select {
+			case <-closed:
+				reconnect = true
+				break publishLoop
+			default:
+			}
+
+			msg, fromBacklog := nextBacklogMessage()
+			if !fromBacklog {
+				if eof {
+					mutex.Lock()
+					drained := len(pending) == 0
+					mutex.Unlock()
+					if drained {
+						break publishLoop
+					}
+					time.Sleep(20 * time.Millisecond)
+					continue
+				}
+				decoded, err := codec.Decode(reader)
+				if err != nil {
+					eof = true
+					if err != io.EOF {
+						readErr = err
+					}
+					continue
+				}
+				msg = decoded
+			}
+
+			routingKey := msg.RoutingKey
+			if routingKey == "" {
+				routingKey = defaultRoutingKey
+			}
+			contentType := msg.ContentType
+			if contentType == "" {
+				contentType = "text/plain"
+			}
+
+			if confirmMode {
+				sem <- struct{}{}
+			}
+
+			tag++
+			err := sess.Publish(
+				c.String("exchange"), // exchange
+				routingKey,           // routing key
+				false,                // mandatory
+				false,                // immediate
+				amqp.Publishing{
+					ContentType:  contentType,
+					Headers:      msg.Headers,
+					Body:         msg.Body,
+					DeliveryMode: deliveryMode,
+				})
+
+			if err != nil {
+				log.Printf("failed to publish a message, reconnecting: %s", err)
+				if confirmMode {
+					<-sem
+				}
+				requeue(msg)
+				reconnect = true
+				break publishLoop
+			}
+
+			if confirmMode {
+				mutex.Lock()
+				pending = append(pending, pendingPublish{tag: tag, msg: msg, sentAt: time.Now()})
+				mutex.Unlock()
+			} else {
+				codec.Encode(os.Stdout, msg)
+			}
+		}
+
+		if confirmMode {
+			mutex.Lock()
+			for i := len(pending) - 1; i >= 0; i-- {
+				backlog = append([]Message{pending[i].msg}, backlog...)
+			}
+			pending = nil
+			mutex.Unlock()
+		}
+
+		sess.Channel.Close()
+		sess.Connection.Close()
+
+		if readErr != nil {
+			failOnError(readErr, "Failed to read from stdin")
+		}
+
+		if !reconnect {
+			return
+		}
+		log.Println("reconnected, resuming publish from stdin")
+	}
+}
+
+// nackPrefix, when it starts a stdin ack line in --ack-on line mode,
+// rejects and requeues the matching message instead of acking it.
+const nackPrefix = "NACK:"
+
+// unackedMsg is a delivery that has been handed to the caller but not yet
+// acked, together with the time it was received (used by --ack-on timeout).
+type unackedMsg struct {
+	delivery amqp.Delivery
+	at       time.Time
 }
 
 func consume(c *cli.Context) {
 	queueName := c.Args().First()
-	if queueName == "" {
-		fmt.Println("Please provide name of the queue")
+	exchangeName := c.String("exchange")
+	if queueName == "" && exchangeName == "" {
+		fmt.Println("Please provide name of the queue, or an exchange to bind an anonymous queue to")
 		os.Exit(1)
 	}
 
-	conn, channel := prepare(c.String("amqpuri"), queueName, !c.Bool("no-create-queue"))
-	defer conn.Close()
-	defer channel.Close()
+	codec := codecFor(c.String("codec"))
+	if codec == nil {
+		failOnError(fmt.Errorf("unknown codec %q", c.String("codec")), "Failed to start consume")
+	}
+	if !c.Bool("autoack") && c.String("ack-on") == "line" {
+		if _, isLine := codec.(lineCodec); !isLine {
+			failOnError(fmt.Errorf("--ack-on line only supports --codec line (the ack-echo reader expects newline-delimited bodies); use --ack-on eof or --ack-on timeout with --codec %s", c.String("codec")), "Failed to start consume")
+		}
+	}
 
+	sessions := redial(c.String("amqpuri"), c.Int("max-retries"), c.Duration("reconnect-delay"))
+
+	// unacked is keyed by message body so a line echoed back on stdin can
+	// be matched to the delivery it acks; a body can be in flight more
+	// than once, so each key holds a FIFO of deliveries.
 	var mutex sync.Mutex
-	unackedMessages := make([]amqp.Delivery, 100)
-
-	msgs, err := channel.Consume(
-		queueName,         // queue
-		"",                // consumer
-		c.Bool("autoack"), // auto-ack
-		false,             // exclusive
-		false,             // no-local
-		false,             // no-wait
-		nil,               // args
-	)
-	failOnError(err, "Failed to register consumer")
-
-	ackMessages := func() {
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			ackedLine := scanner.Text()
-
-			// O(n²) complexity for the win!
-			mutex.Lock() // use channels some day
-			for i, msg := range unackedMessages {
-				unackedLine := fmt.Sprintf("%s", msg.Body)
-				if unackedLine == ackedLine {
-					msg.Ack(false)
-
-					// discard message
-					unackedMessages = append(unackedMessages[:i], unackedMessages[i+1:]...)
-					break
+	unacked := make(map[string][]unackedMsg)
+
+	ackOrNack := func(body string, requeue bool) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		q := unacked[body]
+		if len(q) == 0 {
+			return false
+		}
+		msg := q[0].delivery
+		if len(q) == 1 {
+			delete(unacked, body)
+		} else {
+			unacked[body] = q[1:]
+		}
+		if requeue {
+			msg.Nack(false, true)
+		} else {
+			msg.Ack(false)
+		}
+		return true
+	}
+
+	ackAll := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for body, q := range unacked {
+			for _, u := range q {
+				u.delivery.Ack(false)
+			}
+			delete(unacked, body)
+		}
+	}
+
+	ackExpired := func(ackTimeout time.Duration) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for body, q := range unacked {
+			kept := q[:0]
+			for _, u := range q {
+				if time.Since(u.at) >= ackTimeout {
+					u.delivery.Ack(false)
+				} else {
+					kept = append(kept, u)
 				}
 			}
-			mutex.Unlock()
+			if len(kept) == 0 {
+				delete(unacked, body)
+			} else {
+				unacked[body] = kept
+			}
+		}
+	}
 
+	if !c.Bool("autoack") {
+		switch c.String("ack-on") {
+		case "eof":
+			go func() {
+				io.Copy(ioutil.Discard, os.Stdin)
+				ackAll()
+			}()
+		case "timeout":
+			ackTimeout := c.Duration("ack-timeout")
+			if ackTimeout <= 0 {
+				failOnError(fmt.Errorf("--ack-timeout must be greater than zero"), "Failed to start consume")
+			}
+			go func() {
+				ticker := time.NewTicker(ackTimeout / 4)
+				defer ticker.Stop()
+				for range ticker.C {
+					ackExpired(ackTimeout)
+				}
+			}()
+		default:
+			go func() {
+				scanner := bufio.NewScanner(os.Stdin)
+				for scanner.Scan() {
+					line := scanner.Text()
+					if body := strings.TrimPrefix(line, nackPrefix); body != line {
+						ackOrNack(body, true)
+					} else {
+						ackOrNack(line, false)
+					}
+				}
+				err := scanner.Err()
+				failOnError(err, "Failed to read from stdin")
+			}()
 		}
-		err := scanner.Err()
-		failOnError(err, "Failed to read from stdin")
 	}
 
-	forever := make(chan bool)
+	for sessCh := range sessions {
+		sess, ok := <-sessCh
+		if !ok {
+			failOnError(fmt.Errorf("reconnect attempts exhausted"), "Failed to connect to AMQP broker")
+		}
+
+		if c.Bool("exchange-declare") {
+			declareExchange(sess.Channel, exchangeName, c.String("exchange-type"))
+		}
+
+		queue := queueName
+		if !c.Bool("no-create-queue") {
+			if queueName == "" {
+				q, err := sess.Channel.QueueDeclare(
+					"",    // name: ask the broker to generate one
+					false, // durable
+					false, // delete when unused
+					true,  // exclusive
+					false, // no-wait
+					nil,   // arguments
+				)
+				failOnError(err, "Failed to declare queue")
+				queue = q.Name
+			} else {
+				declareQueue(sess.Channel, queueName)
+			}
+		}
+
+		for _, bindKey := range c.StringSlice("bind-key") {
+			err := sess.Channel.QueueBind(queue, bindKey, exchangeName, false, nil)
+			failOnError(err, "Failed to bind queue")
+		}
+
+		if prefetch := c.Int("prefetch"); prefetch > 0 {
+			failOnError(sess.Channel.Qos(prefetch, 0, false), "Failed to set QoS")
+		}
+
+		msgs, err := sess.Consume(
+			queue,             // queue
+			"",                // consumer
+			c.Bool("autoack"), // auto-ack
+			false,             // exclusive
+			false,             // no-local
+			false,             // no-wait
+			nil,               // args
+		)
+		failOnError(err, "Failed to register consumer")
 
-	consumeMessages := func() {
+		closed := sess.Connection.NotifyClose(make(chan *amqp.Error, 1))
 		timeout := time.Second * time.Duration(c.Int("timeout"))
+		stop := false
+
+	consumeLoop:
 		for {
 			select {
-			case msg := <-msgs:
+			case msg, ok := <-msgs:
+				if !ok {
+					break consumeLoop
+				}
+				body := string(msg.Body)
 				if !c.Bool("autoack") {
 					mutex.Lock()
-					unackedMessages = append(unackedMessages, msg)
+					unacked[body] = append(unacked[body], unackedMsg{delivery: msg, at: time.Now()})
 					mutex.Unlock()
 				}
-				line := fmt.Sprintf("%s", msg.Body)
-				fmt.Println(line)
+				codec.Encode(os.Stdout, Message{
+					Body:        msg.Body,
+					ContentType: msg.ContentType,
+					RoutingKey:  msg.RoutingKey,
+					Headers:     msg.Headers,
+				})
 			case <-time.After(timeout):
 				if c.Bool("non-blocking") {
-					forever <- false
-					return
+					stop = true
+					break consumeLoop
 				}
+			case reason := <-closed:
+				log.Printf("connection closed, reconnecting: %s", reason)
+				break consumeLoop
 			}
 		}
-	}
 
-	if c.Bool("autoack") {
-		go consumeMessages()
-	} else {
-		go ackMessages()
-		go consumeMessages()
+		sess.Channel.Close()
+		sess.Connection.Close()
+
+		if stop {
+			return
+		}
+
+		// messages left unacked on a closed channel are already
+		// considered unacked by the broker and will be redelivered
+		mutex.Lock()
+		unacked = make(map[string][]unackedMsg)
+		mutex.Unlock()
 	}
-	<-forever
 }
 
 func main() {
 	app := cli.NewApp()
 	app.Name = "pipecat"
 	app.Usage = "Connect unix pipes and message queues"
-	app.Version = "0.3"
+	app.Version = "0.8"
 
 	globalFlags := []cli.Flag{
 		cli.StringFlag{
@@ -201,6 +559,68 @@ func main() {
 			Value: 1,
 			Usage: "Timeout to wait for messages",
 		},
+		cli.IntFlag{
+			Name:  "max-retries",
+			Value: 0,
+			Usage: "Max number of reconnect attempts before giving up (0 = retry forever)",
+		},
+		cli.DurationFlag{
+			Name:  "reconnect-delay",
+			Value: time.Second,
+			Usage: "Base delay between reconnect attempts, doubled on each consecutive failure",
+		},
+		cli.BoolFlag{
+			Name:  "confirm",
+			Usage: "Publish: only echo a line to stdout once the broker confirms it",
+		},
+		cli.DurationFlag{
+			Name:  "confirm-timeout",
+			Value: 5 * time.Second,
+			Usage: "Publish: how long to wait for a confirm before requeueing the message",
+		},
+		cli.IntFlag{
+			Name:  "in-flight",
+			Value: 100,
+			Usage: "Publish: max number of unconfirmed messages outstanding at once",
+		},
+		cli.StringFlag{
+			Name:  "exchange-type",
+			Value: "direct",
+			Usage: "Type of --exchange: direct, fanout, topic or headers",
+		},
+		cli.BoolFlag{
+			Name:  "exchange-declare",
+			Usage: "Declare --exchange with --exchange-type before use",
+		},
+		cli.StringFlag{
+			Name:  "routing-key",
+			Value: "",
+			Usage: "Publish: routing key to publish with (default: queue name)",
+		},
+		cli.StringFlag{
+			Name:  "codec",
+			Value: "line",
+			Usage: "Publish/Consume: stdin/stdout framing: line, null, length-prefixed or json-lines",
+		},
+		cli.StringSliceFlag{
+			Name:  "bind-key",
+			Usage: "Consume: binding key to bind the queue to --exchange with (repeatable)",
+		},
+		cli.IntFlag{
+			Name:  "prefetch",
+			Value: 0,
+			Usage: "Consume: QoS prefetch count, bounding in-flight unacked messages (0 = unlimited)",
+		},
+		cli.StringFlag{
+			Name:  "ack-on",
+			Value: "line",
+			Usage: "Consume: when to ack non-autoack messages: line (matching echoed stdin line, --codec line only), eof (ack all once ack stdin closes), or timeout (auto-ack after --ack-timeout)",
+		},
+		cli.DurationFlag{
+			Name:  "ack-timeout",
+			Value: 30 * time.Second,
+			Usage: "Consume: with --ack-on timeout, how long to wait before auto-acking a delivered message",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -218,6 +638,24 @@ func main() {
 			Usage:   "Consume messages from queue",
 			Action:  consume,
 		},
+		{
+			Name:  "rpc",
+			Usage: "Act as an AMQP RPC client or server",
+			Subcommands: []cli.Command{
+				{
+					Name:   "call",
+					Flags:  globalFlags,
+					Usage:  "Publish each stdin line to <queue> and print the matching reply",
+					Action: rpcCall,
+				},
+				{
+					Name:   "serve",
+					Flags:  globalFlags,
+					Usage:  "Pipe each request on <queue> to `cmd args...` and reply with its stdout",
+					Action: rpcServe,
+				},
+			},
+		},
 	}
 
 	app.Run(os.Args)
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/streadway/amqp"
+)
+
+// rpcCall turns pipecat into an AMQP RPC client: each stdin line is
+// published to <queue> with a fresh correlation ID, and the matching
+// reply is printed to stdout.
+func rpcCall(c *cli.Context) {
+	queueName := c.Args().First()
+	if queueName == "" {
+		fmt.Println("Please provide name of the queue to call")
+		os.Exit(1)
+	}
+
+	timeout := time.Second * time.Duration(c.Int("timeout"))
+	sessions := redial(c.String("amqpuri"), c.Int("max-retries"), c.Duration("reconnect-delay"))
+	scanner := bufio.NewScanner(os.Stdin)
+
+	for sessCh := range sessions {
+		sess, ok := <-sessCh
+		if !ok {
+			failOnError(fmt.Errorf("reconnect attempts exhausted"), "Failed to connect to AMQP broker")
+		}
+
+		replyQueue, err := sess.Channel.QueueDeclare(
+			"",    // name: let the broker generate one
+			false, // durable
+			true,  // delete when unused
+			true,  // exclusive
+			false, // no-wait
+			nil,   // arguments
+		)
+		failOnError(err, "Failed to declare reply queue")
+
+		replies, err := sess.Channel.Consume(
+			replyQueue.Name, // queue
+			"",              // consumer
+			true,            // auto-ack
+			true,            // exclusive
+			false,           // no-local
+			false,           // no-wait
+			nil,             // args
+		)
+		failOnError(err, "Failed to register reply consumer")
+
+		// pending maps an in-flight call's correlation ID to the channel
+		// its reply should be delivered on
+		var mutex sync.Mutex
+		pending := make(map[string]chan string)
+
+		go func() {
+			for reply := range replies {
+				mutex.Lock()
+				ch, ok := pending[reply.CorrelationId]
+				mutex.Unlock()
+				if ok {
+					ch <- string(reply.Body)
+				}
+			}
+		}()
+
+		closed := sess.Connection.NotifyClose(make(chan *amqp.Error, 1))
+		reconnect := false
+		var corrSeq uint64
+
+	callLoop:
+		for scanner.Scan() {
+			select {
+			case <-closed:
+				reconnect = true
+				break callLoop
+			default:
+			}
+
+			line := scanner.Text()
+			corrSeq++
+			corrId := strconv.FormatUint(corrSeq, 10)
+
+			reply := make(chan string, 1)
+			mutex.Lock()
+			pending[corrId] = reply
+			mutex.Unlock()
+
+			err := sess.Channel.Publish(
+				c.String("exchange"), // exchange
+				queueName,            // routing key
+				false,                // mandatory
+				false,                // immediate
+				amqp.Publishing{
+					ContentType:   "text/plain",
+					CorrelationId: corrId,
+					ReplyTo:       replyQueue.Name,
+					Body:          []byte(line),
+				})
+
+			if err != nil {
+				log.Printf("failed to publish RPC call, reconnecting: %s", err)
+				mutex.Lock()
+				delete(pending, corrId)
+				mutex.Unlock()
+				reconnect = true
+				break callLoop
+			}
+
+			select {
+			case body := <-reply:
+				fmt.Println(body)
+			case <-time.After(timeout):
+				log.Printf("timed out waiting for a reply to %q", line)
+			}
+
+			mutex.Lock()
+			delete(pending, corrId)
+			mutex.Unlock()
+		}
+
+		sess.Channel.Close()
+		sess.Connection.Close()
+
+		if err := scanner.Err(); err != nil {
+			failOnError(err, "Failed to read from stdin")
+		}
+
+		if !reconnect {
+			return
+		}
+		log.Println("reconnected, resuming RPC calls from stdin")
+	}
+}
+
+// rpcServe turns pipecat into an AMQP RPC server: each request on <queue>
+// is piped to a fresh invocation of cmdArgs and replied to with its stdout.
+func rpcServe(c *cli.Context) {
+	queueName := c.Args().First()
+	cmdArgs := []string(c.Args().Tail())
+	// flag parsing stops at <queue>, so the "--" before cmd is still here
+	if len(cmdArgs) > 0 && cmdArgs[0] == "--" {
+		cmdArgs = cmdArgs[1:]
+	}
+	if queueName == "" || len(cmdArgs) == 0 {
+		fmt.Println("Usage: pipecat rpc serve <queue> -- cmd [args...]")
+		os.Exit(1)
+	}
+
+	sessions := redial(c.String("amqpuri"), c.Int("max-retries"), c.Duration("reconnect-delay"))
+
+	for sessCh := range sessions {
+		sess, ok := <-sessCh
+		if !ok {
+			failOnError(fmt.Errorf("reconnect attempts exhausted"), "Failed to connect to AMQP broker")
+		}
+
+		if !c.Bool("no-create-queue") {
+			declareQueue(sess.Channel, queueName)
+		}
+
+		if prefetch := c.Int("prefetch"); prefetch > 0 {
+			failOnError(sess.Channel.Qos(prefetch, 0, false), "Failed to set QoS")
+		}
+
+		requests, err := sess.Channel.Consume(
+			queueName, // queue
+			"",        // consumer
+			false,     // auto-ack
+			false,     // exclusive
+			false,     // no-local
+			false,     // no-wait
+			nil,       // args
+		)
+		failOnError(err, "Failed to register consumer")
+
+		closed := sess.Connection.NotifyClose(make(chan *amqp.Error, 1))
+		reconnect := false
+
+	serveLoop:
+		for {
+			select {
+			case req, ok := <-requests:
+				if !ok {
+					break serveLoop
+				}
+				go handleRPCRequest(sess.Channel, cmdArgs, req)
+			case reason := <-closed:
+				log.Printf("connection closed, reconnecting: %s", reason)
+				reconnect = true
+				break serveLoop
+			}
+		}
+
+		sess.Channel.Close()
+		sess.Connection.Close()
+
+		if !reconnect {
+			return
+		}
+		log.Println("reconnected, resuming RPC service")
+	}
+}
+
+// handleRPCRequest runs cmdArgs with req's body on stdin and publishes its
+// stdout back to req.ReplyTo, nacking req without requeue on failure.
+func handleRPCRequest(channel *amqp.Channel, cmdArgs []string, req amqp.Delivery) {
+	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	cmd.Stdin = bytes.NewReader(req.Body)
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		log.Printf("failed to run %q: %s", strings.Join(cmdArgs, " "), err)
+		req.Nack(false, false)
+		return
+	}
+
+	if req.ReplyTo != "" {
+		// ReplyTo names an exclusive reply queue, only addressable through
+		// the default exchange, regardless of which exchange the request
+		// itself was routed through.
+		err = channel.Publish(
+			"",          // exchange
+			req.ReplyTo, // routing key
+			false,       // mandatory
+			false,       // immediate
+			amqp.Publishing{
+				ContentType:   "text/plain",
+				CorrelationId: req.CorrelationId,
+				Body:          bytes.TrimRight(output, "\n"),
+			})
+		if err != nil {
+			log.Printf("failed to publish RPC reply: %s", err)
+		}
+	}
+
+	req.Ack(false)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Session bundles an AMQP connection together with the channel opened on
+// it, so callers have a single value to close and to watch for broker
+// disconnects.
+type Session struct {
+	*amqp.Connection
+	*amqp.Channel
+}
+
+// maxBackoff caps the exponential delay between redial attempts so a long
+// broker outage doesn't leave pipecat waiting for minutes between tries.
+const maxBackoff = 30 * time.Second
+
+// redial dials amqpUri in a loop, sending a fresh Session down a channel
+// of its own every time the previous one closes (the session-factory
+// pattern from the streadway/amqp pubsub example). Dial failures are
+// retried with exponential backoff starting at delay; if maxRetries is
+// greater than zero, redial gives up and closes both channels after that
+// many consecutive failures, zero meaning retry forever.
+func redial(amqpUri string, maxRetries int, delay time.Duration) chan chan Session {
+	sessions := make(chan chan Session)
+
+	go func() {
+		defer close(sessions)
+
+		attempt := 0
+		for {
+			sess := make(chan Session)
+			sessions <- sess
+
+			conn, err := amqp.Dial(amqpUri)
+			for err != nil {
+				attempt++
+				if maxRetries > 0 && attempt >= maxRetries {
+					log.Printf("giving up on %s after %d attempts: %s", amqpUri, attempt, err)
+					close(sess)
+					return
+				}
+				wait := backoff(delay, attempt)
+				log.Printf("failed to connect to %s, retrying in %s: %s", amqpUri, wait, err)
+				time.Sleep(wait)
+				conn, err = amqp.Dial(amqpUri)
+			}
+			attempt = 0
+
+			channel, err := conn.Channel()
+			failOnError(err, "Failed to open a channel")
+
+			sess <- Session{conn, channel}
+
+			log.Printf("connected to %s", amqpUri)
+			reason := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+			log.Printf("connection to %s closed, reconnecting: %s", amqpUri, reason)
+		}
+	}()
+
+	return sessions
+}
+
+// backoff returns the delay to wait before the given retry attempt,
+// doubling each time up to maxBackoff.
+func backoff(delay time.Duration, attempt int) time.Duration {
+	wait := delay * time.Duration(1<<uint(attempt-1))
+	if wait > maxBackoff || wait <= 0 {
+		return maxBackoff
+	}
+	return wait
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRedialClosesInnerChannelAfterMaxRetries ensures that once redial
+// gives up after exhausting maxRetries, it closes the inner session
+// channel it already handed to the caller instead of leaving the
+// caller's `sess, ok := <-sessCh` blocked forever.
+func TestRedialClosesInnerChannelAfterMaxRetries(t *testing.T) {
+	// Port 0 is never listening, so amqp.Dial fails immediately on every
+	// attempt without a network timeout.
+	sessions := redial("amqp://127.0.0.1:0", 2, time.Millisecond)
+
+	sessCh, ok := <-sessions
+	if !ok {
+		t.Fatal("expected an inner session channel before giving up")
+	}
+
+	select {
+	case _, ok := <-sessCh:
+		if ok {
+			t.Fatal("expected inner channel to be closed after max retries, got a Session")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for inner channel to close after max retries")
+	}
+
+	if _, ok := <-sessions; ok {
+		t.Fatal("expected outer channel to be closed after giving up")
+	}
+}